@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// archiveCacheSize bounds how many rendered tarballs are kept in memory at
+// once, evicting the least recently used entry once the limit is reached.
+const archiveCacheSize = 32
+
+type archiveCacheKey struct {
+	localname string
+	sha       string
+}
+
+type archiveCache struct {
+	mu      sync.Mutex
+	entries map[archiveCacheKey]*list.Element
+	order   *list.List
+}
+
+type archiveCacheEntry struct {
+	key  archiveCacheKey
+	data []byte
+}
+
+var archives = &archiveCache{
+	entries: make(map[archiveCacheKey]*list.Element),
+	order:   list.New(),
+}
+
+func (c *archiveCache) get(key archiveCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*archiveCacheEntry).data, true
+}
+
+func (c *archiveCache) put(key archiveCacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*archiveCacheEntry).data = data
+		return
+	}
+	elem := c.order.PushFront(&archiveCacheEntry{key: key, data: data})
+	c.entries[key] = elem
+	for c.order.Len() > archiveCacheSize {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*archiveCacheEntry).key)
+	}
+}
+
+// httpMux is the single HTTP surface gitflect exposes under -http: archive
+// downloads and /debug/watcher here, /trigger and /webhook added by the
+// daemon scheduler.
+var httpMux = http.NewServeMux()
+
+// startArchiveServer serves a tar.gz of every mirrored project's working
+// tree, plus a /debug/watcher endpoint describing the current mirror state.
+func startArchiveServer(addr string) {
+	httpMux.HandleFunc("/debug/watcher", handleDebugWatcher)
+	httpMux.HandleFunc("/", handleArchiveRequest)
+
+	log.Printf("Serving archives on %s\n", addr)
+	if err := http.ListenAndServe(addr, httpMux); err != nil {
+		log.Printf("Archive server stopped: %v\n", err)
+	}
+}
+
+func handleDebugWatcher(w http.ResponseWriter, r *http.Request) {
+	watcherStates.mu.Lock()
+	states := make([]*WatcherState, 0, len(watcherStates.m))
+	for _, state := range watcherStates.m {
+		states = append(states, state)
+	}
+	watcherStates.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
+// handleArchiveRequest serves /<localname>.tar.gz and /<localname>/<rev>.tar.gz.
+func handleArchiveRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".tar.gz")
+	if !strings.HasSuffix(r.URL.Path, ".tar.gz") || path == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	localname := path
+	rev := "HEAD"
+	if idx := strings.LastIndex(path, "/"); idx != -1 {
+		localname = path[:idx]
+		rev = path[idx+1:]
+	}
+
+	projectPath, ok := projectDataPath(localname)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	repo, err := loadRepo(projectPath, localname)
+	if err != nil {
+		http.Error(w, "could not open repository", http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not resolve revision %q: %v", rev, err), http.StatusNotFound)
+		return
+	}
+
+	key := archiveCacheKey{localname: localname, sha: hash.String()}
+	if data, hit := archives.get(key); hit {
+		writeArchive(w, localname, data)
+		return
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load commit %s: %v", hash, err), http.StatusInternalServerError)
+		return
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load tree for %s: %v", hash, err), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := buildTarGz(tree)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not build archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	archives.put(key, data)
+	writeArchive(w, localname, data)
+}
+
+func writeArchive(w http.ResponseWriter, localname string, data []byte) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", localname))
+	w.Write(data)
+}
+
+func buildTarGz(tree *object.Tree) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	err := tree.Files().ForEach(func(f *object.File) error {
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name: f.Name,
+			Mode: int64(f.Mode),
+			Size: int64(len(contents)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.WriteString(tw, contents)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// projectDataPath resolves where a project's bare repo actually lives on
+// disk. With cfg.Snapshot enabled that's the newest timestamped snapshot
+// directory (see retention.go), not cfg.DataPath+localname directly.
+func projectDataPath(localname string) (string, bool) {
+	if _, ok := findProject(localname); !ok {
+		return "", false
+	}
+
+	if cfg.Snapshot {
+		snapshots, err := listSnapshots(localname)
+		if err != nil || len(snapshots) == 0 {
+			return "", false
+		}
+		return snapshots[len(snapshots)-1], true
+	}
+
+	return cfg.DataPath + localname, true
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	gittransport "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// DestinationConfig describes one named push target. Projects reference a
+// destination by Name; a Project without one falls back to the legacy
+// ssh-git behaviour using cfg.DefaultURL.
+type DestinationConfig struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"` // ssh-git, gitea, gitlab, s3, gs, file
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// Owner is the org (Gitea) or group (GitLab) namespace to create the
+	// mirror in. Empty means "the token owner's personal namespace".
+	Owner       string `yaml:"owner"`
+	Description string `yaml:"description"`
+	Private     bool   `yaml:"private"`
+}
+
+// Destination pushes a locally mirrored bare repo somewhere, bootstrapping
+// the target repo first if the backend requires it.
+type Destination interface {
+	Push(repo *git.Repository, project Project, localPath string) error
+}
+
+func resolveDestination(name string) (Destination, error) {
+	if name == "" {
+		return sshGitDestination{}, nil
+	}
+	for _, dest := range cfg.Destinations {
+		if dest.Name != name {
+			continue
+		}
+		switch dest.Type {
+		case "ssh-git":
+			return sshGitDestination{}, nil
+		case "gitea":
+			return giteaDestination{config: dest}, nil
+		case "gitlab":
+			return gitlabDestination{config: dest}, nil
+		case "s3", "gs", "file":
+			return blobDestination{config: dest}, nil
+		default:
+			return nil, fmt.Errorf("unknown destination type %q for destination %q", dest.Type, name)
+		}
+	}
+	return nil, fmt.Errorf("no destination named %q configured", name)
+}
+
+// sshGitDestination is the original behaviour: push the bare mirror over SSH
+// to cfg.DefaultURL + localname.
+type sshGitDestination struct{}
+
+func (sshGitDestination) Push(repo *git.Repository, project Project, localPath string) error {
+	targetURL := cfg.DefaultURL + project.LocalName
+	if project.Mode == "cli" {
+		return cliPush(localPath, targetURL, "", project.LocalName)
+	}
+	repo.DeleteRemote("gittig")
+	if err := setRemote(repo, targetURL); err != nil {
+		return err
+	}
+	return push(repo, project.LocalName)
+}
+
+// giteaDestination auto-creates the target repo via the Gitea API (copying
+// description/visibility from the source when it's a GitHub repo) and then
+// pushes over HTTPS using the configured token.
+type giteaDestination struct {
+	config DestinationConfig
+}
+
+func (d giteaDestination) Push(repo *git.Repository, project Project, localPath string) error {
+	createURL := d.config.URL + "/api/v1/user/repos"
+	if d.config.Owner != "" {
+		createURL = d.config.URL + "/api/v1/orgs/" + d.config.Owner + "/repos"
+	}
+	if err := ensureRemoteRepo(createURL, d.config, project, "gitea"); err != nil {
+		return err
+	}
+	owner := d.config.Owner
+	if owner == "" {
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := fetchPage("gitea", d.config.URL+"/api/v1/user", d.config.Token, &user); err != nil {
+			return fmt.Errorf("could not resolve gitea user for token: %v", err)
+		}
+		owner = user.Login
+	}
+	targetURL := d.config.URL + "/" + owner + "/" + project.LocalName + ".git"
+	if project.Mode == "cli" {
+		return cliPush(localPath, targetURL, d.config.Token, project.LocalName)
+	}
+	return pushOverHTTP(repo, targetURL, d.config.Token, project.LocalName)
+}
+
+// gitlabDestination mirrors giteaDestination for the GitLab REST API.
+type gitlabDestination struct {
+	config DestinationConfig
+}
+
+func (d gitlabDestination) Push(repo *git.Repository, project Project, localPath string) error {
+	if err := ensureRemoteRepo(d.config.URL+"/api/v4/projects", d.config, project, "gitlab"); err != nil {
+		return err
+	}
+	owner := d.config.Owner
+	if owner == "" {
+		var user struct {
+			Username string `json:"username"`
+		}
+		if err := fetchPage("gitlab", d.config.URL+"/api/v4/user", d.config.Token, &user); err != nil {
+			return fmt.Errorf("could not resolve gitlab user for token: %v", err)
+		}
+		owner = user.Username
+	}
+	targetURL := d.config.URL + "/" + owner + "/" + project.LocalName + ".git"
+	if project.Mode == "cli" {
+		return cliPush(localPath, targetURL, d.config.Token, project.LocalName)
+	}
+	return pushOverHTTP(repo, targetURL, d.config.Token, project.LocalName)
+}
+
+// ensureRemoteRepo calls a "create repo" REST endpoint, ignoring the error
+// that both Gitea and GitLab return when the repo already exists. kind
+// selects the request body shape ("gitea" or "gitlab"), since GitLab has no
+// boolean "private" field and instead wants visibility: public|private|internal.
+func ensureRemoteRepo(createURL string, config DestinationConfig, project Project, kind string) error {
+	description := config.Description
+	private := config.Private
+	if meta, ok := githubSourceMeta(project.OriginURL); ok {
+		description = meta.Description
+		private = meta.Private
+	}
+
+	var payload map[string]interface{}
+	switch kind {
+	case "gitlab":
+		visibility := "public"
+		if private {
+			visibility = "private"
+		}
+		payload = map[string]interface{}{
+			"name":        project.LocalName,
+			"description": description,
+			"visibility":  visibility,
+		}
+		if config.Owner != "" {
+			namespaceID, err := resolveGitlabNamespaceID(config)
+			if err != nil {
+				return fmt.Errorf("could not resolve gitlab namespace %q: %v", config.Owner, err)
+			}
+			payload["namespace_id"] = namespaceID
+		}
+	default:
+		payload = map[string]interface{}{
+			"name":        project.LocalName,
+			"description": description,
+			"private":     private,
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", createURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if kind == "gitlab" {
+		req.Header.Set("PRIVATE-TOKEN", config.Token)
+	} else {
+		req.Header.Set("Authorization", "token "+config.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if kind == "gitlab" && resp.StatusCode == http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		if strings.Contains(string(msg), "has already been taken") {
+			return nil
+		}
+	}
+	return fmt.Errorf("could not create repo %q: unexpected status %d", project.LocalName, resp.StatusCode)
+}
+
+// resolveGitlabNamespaceID looks up the numeric namespace id GitLab's
+// project-create API requires for config.Owner (a group or user path);
+// unlike Gitea, GitLab has no "create under this named group" path segment.
+func resolveGitlabNamespaceID(config DestinationConfig) (int, error) {
+	var namespaces []struct {
+		ID int `json:"id"`
+	}
+	searchURL := fmt.Sprintf("%s/api/v4/namespaces?search=%s", strings.TrimSuffix(config.URL, "/"), url.QueryEscape(config.Owner))
+	if err := fetchPage("gitlab", searchURL, config.Token, &namespaces); err != nil {
+		return 0, err
+	}
+	if len(namespaces) == 0 {
+		return 0, fmt.Errorf("no gitlab namespace found for %q", config.Owner)
+	}
+	return namespaces[0].ID, nil
+}
+
+type githubMeta struct {
+	Description string
+	Private     bool
+}
+
+// githubSourceMeta fetches description/visibility from the GitHub API when
+// originURL points at github.com, so auto-created Gitea/GitLab mirrors can
+// carry over the source repo's metadata. ok is false for any other origin,
+// or if the lookup fails, in which case callers fall back to the
+// destination's own configured description/private.
+func githubSourceMeta(originURL string) (githubMeta, bool) {
+	owner, name, ok := githubOwnerRepo(originURL)
+	if !ok {
+		return githubMeta{}, false
+	}
+
+	var meta struct {
+		Description string `json:"description"`
+		Private     bool   `json:"private"`
+	}
+	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s", owner, name)
+	if err := fetchPage("github", apiURL, "", &meta); err != nil {
+		return githubMeta{}, false
+	}
+	return githubMeta{Description: meta.Description, Private: meta.Private}, true
+}
+
+// githubOwnerRepo extracts "owner", "repo" from a github.com clone URL, in
+// either https://github.com/owner/repo(.git) or git@github.com:owner/repo(.git) form.
+func githubOwnerRepo(originURL string) (owner, repo string, ok bool) {
+	path := originURL
+	switch {
+	case strings.Contains(originURL, "github.com/"):
+		path = strings.SplitN(originURL, "github.com/", 2)[1]
+	case strings.Contains(originURL, "github.com:"):
+		path = strings.SplitN(originURL, "github.com:", 2)[1]
+	default:
+		return "", "", false
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func pushOverHTTP(repo *git.Repository, targetURL, token, reponame string) error {
+	repo.DeleteRemote("gittig")
+	if err := setRemote(repo, targetURL); err != nil {
+		return err
+	}
+
+	err := repo.Push(&git.PushOptions{
+		RemoteName: "gittig",
+		Prune:      true,
+		Auth: &gittransport.BasicAuth{
+			Username: "gitflect",
+			Password: token,
+		},
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// blobDestination archives the bare mirror as a tar.gz and writes it to a
+// blob store (s3://, gs://, file://) instead of pushing over git.
+type blobDestination struct {
+	config DestinationConfig
+}
+
+func (d blobDestination) Push(repo *git.Repository, project Project, localPath string) error {
+	data, err := archiveBareRepo(localPath)
+	if err != nil {
+		return err
+	}
+	return writeBlob(d.config.URL+"/"+project.LocalName+".tar.gz", data)
+}
+
+func archiveBareRepo(localPath string) ([]byte, error) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	err := filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = relPath
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBlob uploads data to an s3://, gs:// or file:// URL. The cloud
+// backends shell out to the respective CLI, which is assumed to already be
+// configured with credentials (aws configure / gcloud auth).
+func writeBlob(blobURL string, data []byte) error {
+	parsed, err := url.Parse(blobURL)
+	if err != nil {
+		return err
+	}
+
+	switch parsed.Scheme {
+	case "file":
+		path := parsed.Path
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0644)
+	case "s3":
+		return uploadViaCLI("aws", []string{"s3", "cp", "-", blobURL}, data)
+	case "gs":
+		return uploadViaCLI("gsutil", []string{"cp", "-", blobURL}, data)
+	default:
+		return fmt.Errorf("unsupported blob destination scheme %q", parsed.Scheme)
+	}
+}
+
+func uploadViaCLI(name string, args []string, data []byte) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", name, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runGit shells out to the system git binary, streaming its stderr into the
+// existing addOutputLine log so CLI-mode failures show up next to go-git
+// ones. go-git (v4) can't handle LFS objects or recursive submodules, so
+// projects with mode: cli fall back to this for clone/fetch/push.
+func runGit(dir string, reponame string, args ...string) error {
+	return runGitEnv(dir, reponame, nil, args...)
+}
+
+// runGitEnv is runGit plus extraEnv appended to the child's environment,
+// used by cliPush to hand a destination token to git via GIT_ASKPASS instead
+// of the URL, so it never shows up in `ps` or /proc/<pid>/cmdline.
+func runGitEnv(dir, reponame string, extraEnv []string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if len(extraEnv) > 0 {
+		cmd.Env = append(os.Environ(), extraEnv...)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		addOutputLine(scanner.Text(), reponame)
+	}
+
+	return cmd.Wait()
+}
+
+// cliClone mirror-clones url into localPath using the system git binary.
+func cliClone(url, localPath, reponame string) error {
+	updateState(statusDownload, reponame)
+	if _, err := os.Stat(filepath.Join(localPath, "HEAD")); err == nil {
+		addOutputLine("Repo already exists, nice...", reponame)
+		return nil
+	}
+	if err := runGit("", reponame, "clone", "--mirror", url, localPath); err != nil {
+		addOutputLine(fmt.Sprintf("git clone --mirror failed: %v", err), reponame)
+		updateState(statusError, reponame)
+		return err
+	}
+	return nil
+}
+
+// cliFetch refreshes an existing mirror, including LFS objects and
+// submodules, which go-git silently drops.
+func cliFetch(localPath, reponame string) error {
+	updateState(statusDownload, reponame)
+
+	if err := runGit(localPath, reponame, "fetch", "--prune", "--tags"); err != nil {
+		addOutputLine(fmt.Sprintf("git fetch failed: %v", err), reponame)
+		updateState(statusError, reponame)
+		return err
+	}
+
+	if err := runGit(localPath, reponame, "lfs", "fetch", "--all"); err != nil {
+		addOutputLine(fmt.Sprintf("git lfs fetch failed (repo may not use LFS): %v", err), reponame)
+	}
+
+	if err := mirrorSubmodules(localPath, reponame); err != nil {
+		addOutputLine(fmt.Sprintf("Mirroring submodules failed: %v", err), reponame)
+		updateState(statusError, reponame)
+		return err
+	}
+
+	recordFetch(reponame)
+	return nil
+}
+
+// mirrorSubmodules mirrors every submodule referenced by HEAD's .gitmodules
+// as its own bare clone under localPath/submodules/<path>.git, recursing into
+// each submodule's own submodules in turn. `git submodule update` needs a
+// checked-out working tree to read .gitmodules and the gitlink commits from,
+// which a --mirror clone doesn't have, so it can never succeed here -
+// mirroring each submodule as an independent repo is the bare-clone
+// equivalent.
+func mirrorSubmodules(localPath, reponame string) error {
+	gitmodules, err := exec.Command("git", "-C", localPath, "show", "HEAD:.gitmodules").Output()
+	if err != nil {
+		// No .gitmodules at HEAD: this repo has no submodules to mirror.
+		return nil
+	}
+
+	originURL, err := exec.Command("git", "-C", localPath, "remote", "get-url", "origin").Output()
+	if err != nil {
+		return fmt.Errorf("could not resolve origin url for submodule resolution: %v", err)
+	}
+
+	for _, sub := range parseGitmodules(string(gitmodules)) {
+		subURL := resolveSubmoduleURL(strings.TrimSpace(string(originURL)), sub.url)
+		subReponame := reponame + "/" + sub.path
+		subPath := filepath.Join(localPath, "submodules", sub.path+".git")
+		if err := cliClone(subURL, subPath, subReponame); err != nil {
+			return fmt.Errorf("submodule %s: %v", sub.path, err)
+		}
+		if err := cliFetch(subPath, subReponame); err != nil {
+			return fmt.Errorf("submodule %s: %v", sub.path, err)
+		}
+	}
+	return nil
+}
+
+// resolveSubmoduleURL mirrors git's own rule for interpreting the url= field
+// of a .gitmodules entry: URLs that don't start with "./" or "../" are
+// absolute and used as-is; anything else is resolved against originURL itself
+// treated as a directory, so "../sibling.git" next to ".../group/repo.git"
+// becomes ".../group/sibling.git".
+func resolveSubmoduleURL(originURL, subURL string) string {
+	if !strings.HasPrefix(subURL, "./") && !strings.HasPrefix(subURL, "../") {
+		return subURL
+	}
+
+	if u, err := url.Parse(originURL); err == nil && u.Scheme != "" {
+		u.Path = path.Join(u.Path, subURL)
+		return u.String()
+	}
+
+	// scp-like syntax (e.g. "git@host:group/repo.git") has no scheme for
+	// url.Parse to recognise, so resolve the path after the colon by hand.
+	host, dir, found := strings.Cut(originURL, ":")
+	if !found {
+		return subURL
+	}
+	return host + ":" + path.Join(dir, subURL)
+}
+
+type gitSubmodule struct {
+	path string
+	url  string
+}
+
+// parseGitmodules extracts path/url pairs from a .gitmodules file's
+// contents. It only understands the flat "key = value" lines git itself
+// writes, which is all gitflect needs to know where to mirror each
+// submodule from.
+func parseGitmodules(contents string) []gitSubmodule {
+	var submodules []gitSubmodule
+	var current gitSubmodule
+	var inSection bool
+
+	flush := func() {
+		if inSection && current.path != "" && current.url != "" {
+			submodules = append(submodules, current)
+		}
+	}
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[submodule") {
+			flush()
+			current = gitSubmodule{}
+			inSection = true
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "path":
+			current.path = value
+		case "url":
+			current.url = value
+		}
+	}
+	flush()
+	return submodules
+}
+
+// cliPush mirror-pushes a bare repo to targetURL using the system git binary.
+// token authenticates the push, if the destination needs it (ssh-git passes an
+// empty token, and git then uses its own SSH setup; cfg.SSHKey is not handed
+// to it); it is
+// handed to git via a short-lived GIT_ASKPASS helper rather than embedded in
+// targetURL, so it never appears in `ps` or /proc/<pid>/cmdline.
+func cliPush(localPath, targetURL, token, reponame string) error {
+	var extraEnv []string
+	if token != "" {
+		askpass, cleanup, err := writeAskpassHelper()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		extraEnv = []string{"GIT_ASKPASS=" + askpass, "GITFLECT_PUSH_TOKEN=" + token}
+	}
+
+	if err := runGitEnv(localPath, reponame, extraEnv, "push", "--mirror", targetURL); err != nil {
+		addOutputLine(fmt.Sprintf("git push --mirror failed: %v", err), reponame)
+		return err
+	}
+	recordPush(reponame)
+	return nil
+}
+
+// writeAskpassHelper writes a short-lived script that answers any GIT_ASKPASS
+// prompt (git asks for both a username and a password) with
+// GITFLECT_PUSH_TOKEN, so cliPush's caller never has to put the token on the
+// command line. The caller is responsible for calling the returned cleanup
+// once the git invocation using it has finished.
+func writeAskpassHelper() (path string, cleanup func(), err error) {
+	f, err := ioutil.TempFile("", "gitflect-askpass-*")
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := f.WriteString("#!/bin/sh\necho \"$GITFLECT_PUSH_TOKEN\"\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	if err := os.Chmod(f.Name(), 0700); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
@@ -24,6 +24,7 @@ const githubURL = "https://github.com/"
 
 var (
 	configFile = flag.String("config-file", "config.yaml", "path to custom configuration file")
+	httpAddr   = flag.String("http", "", "address to serve repo archives and /debug/watcher on, e.g. :8080 (disabled if empty)")
 	// mazeFile   = flag.String("maze-file", "maze01.txt", "path to a custom maze file")
 )
 
@@ -38,21 +39,37 @@ const (
 )
 
 type Project struct {
-	LocalName string `yaml:"local_name"`
-	OriginURL string `yaml:"origin_url"`
+	LocalName    string `yaml:"local_name"`
+	OriginURL    string `yaml:"origin_url"`
+	Destination  string `yaml:"destination"`
+	PollInterval string `yaml:"poll_interval"`
+	// Mode selects the clone/fetch/push implementation: "gogit" (default)
+	// uses go-git, "cli" shells out to the system git binary for LFS and
+	// submodule support.
+	Mode string `yaml:"mode"`
+	// Keep is the number of timestamped snapshots to retain when
+	// cfg.Snapshot is enabled; older snapshots are pruned after each run.
+	Keep int `yaml:"keep"`
 }
 
 type Config struct {
-	DefaultURL     string             `yaml:"default_url"`
-	DataPath       string             `yaml:"data_path"`
-	SSHKey         string             `yaml:"ssh_key"`
-	Parallel       bool               `yaml:"parallel"`
-	GithubProjects []string           `yaml:"github_projects"`
-	Projects       map[string]Project `yaml:"projects"`
+	DefaultURL     string              `yaml:"default_url"`
+	DataPath       string              `yaml:"data_path"`
+	SSHKey         string              `yaml:"ssh_key"`
+	Parallel       bool                `yaml:"parallel"`
+	GithubProjects []string            `yaml:"github_projects"`
+	Projects       map[string]Project  `yaml:"projects"`
+	Sources        []Source            `yaml:"sources"`
+	Destinations   []DestinationConfig `yaml:"destinations"`
+	PollInterval   string              `yaml:"poll_interval"`
+	Workers        int                 `yaml:"workers"`
+	WebhookSecret  string              `yaml:"webhook_secret"`
+	Snapshot       bool                `yaml:"snapshot"`
 }
 
 var PublicKey *ssh.PublicKeys
 var cfg Config
+var sourceProjects []Project
 
 func loadConfig() error {
 
@@ -80,6 +97,11 @@ func loadConfig() error {
 	}
 	PublicKey = publicKey
 
+	sourceProjects, err = resolveSources()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -136,12 +158,14 @@ func fetch(repo *git.Repository, reponame string) error {
 	if err == git.NoErrAlreadyUpToDate {
 		addOutputLine(fmt.Sprintf("Already up to date"), reponame)
 		//		log.Printf("Already up to date")
+		recordFetch(reponame)
 		return nil
 	} else if err != nil {
 		addOutputLine(fmt.Sprintf("Fetching existing repo failed: %v\n", err), reponame)
 		updateState(statusError, reponame)
 		return err
 	}
+	recordFetch(reponame)
 	return nil
 }
 
@@ -162,71 +186,142 @@ func push(repo *git.Repository, reponame string) error {
 
 	if err == git.NoErrAlreadyUpToDate {
 		updateState(statusDoneNothing, reponame)
+		recordPush(reponame)
 		return nil
 	} else if err == nil {
 		updateState(statusDone, reponame)
+		recordPush(reponame)
 	}
 	updateState(statusError, reponame)
 	addOutputLine(fmt.Sprintf("Error occured: [%v](fg:red)", err), reponame)
 	return err
 }
 
-func processProject(url, localname string) error {
+func processProject(project Project) error {
+	localname := project.LocalName
 
 	addOutputLine("Processing Project", localname)
 
-	targetURL := cfg.DefaultURL + localname
 	projectPath := cfg.DataPath + localname
 	updateState(statusWaiting, localname)
-	clone(url, projectPath, localname)
-	repo, err := loadRepo(projectPath, localname)
-	if err != nil {
-		updateState(statusError, localname)
-		return errors.New("Loading Repo failed")
+
+	if cfg.Snapshot {
+		unchanged, err := snapshotUnchanged(project)
+		if err != nil {
+			addOutputLine(fmt.Sprintf("ls-remote failed, taking a new snapshot anyway: %v", err), localname)
+		} else if unchanged {
+			addOutputLine("Remote unchanged since last snapshot, skipping", localname)
+			updateState(statusDoneNothing, localname)
+			pruneSnapshots(project)
+			return nil
+		}
+		projectPath = snapshotPath(localname, time.Now().Unix())
+	}
+
+	var repo *git.Repository
+	var err error
+	if project.Mode == "cli" {
+		if err = cliClone(project.OriginURL, projectPath, localname); err != nil {
+			updateState(statusError, localname)
+			return errors.New("Cloning Repo failed")
+		}
+		if err = cliFetch(projectPath, localname); err != nil {
+			updateState(statusError, localname)
+			return errors.New("Fetching Repo failed")
+		}
+	} else {
+		clone(project.OriginURL, projectPath, localname)
+		repo, err = loadRepo(projectPath, localname)
+		if err != nil {
+			updateState(statusError, localname)
+			return errors.New("Loading Repo failed")
+		}
+		err = fetch(repo, localname)
+		if err != nil {
+			updateState(statusError, localname)
+			return errors.New("Fetching Repo failed")
+		}
 	}
-	fetch(repo, localname)
+
+	dest, err := resolveDestination(project.Destination)
 	if err != nil {
+		addOutputLine(fmt.Sprintf("Could not resolve destination: %v", err), localname)
 		updateState(statusError, localname)
-		return errors.New("Fetching Repo failed")
+		return err
 	}
 
-	repo.DeleteRemote("gittig")
-	setRemote(repo, targetURL)
-
 	updateState(statusUpload, localname)
-	err = push(repo, localname)
-	return err
+	err = dest.Push(repo, project, projectPath)
+	if err != nil {
+		updateState(statusError, localname)
+		addOutputLine(fmt.Sprintf("Error occured: [%v](fg:red)", err), localname)
+		return err
+	}
+	updateState(statusDone, localname)
+	recordPush(localname)
+	if cfg.Snapshot {
+		pruneSnapshots(project)
+	}
+	return nil
 }
 
-func startProcessing() {
-	wg := sync.WaitGroup{}
+// allProjects returns every project gitflect knows about, regardless of
+// which config section it came from.
+func allProjects() []Project {
+	var projects []Project
 	for projectkey := range cfg.Projects {
-		project := cfg.Projects[projectkey]
-		if cfg.Parallel {
-			go processProject(project.OriginURL, project.LocalName)
-			addActiveRepo(project.LocalName)
-			wg.Add(1)
-		} else {
-			processProject(project.OriginURL, project.LocalName)
-		}
+		projects = append(projects, cfg.Projects[projectkey])
 	}
-
-	for _, project := range cfg.GithubProjects {
-		if cfg.Parallel {
-			go processProject(githubURL+project, project)
-			addActiveRepo(project)
-			wg.Add(1)
-		} else {
-			processProject(githubURL+project, project)
-		}
+	for _, projectname := range cfg.GithubProjects {
+		projects = append(projects, Project{LocalName: projectname, OriginURL: githubURL + projectname})
 	}
-
+	projects = append(projects, sourceProjects...)
+	return projects
 }
 
 var grid *ui.Grid
 var repoList *widgets.Table
 var textList *widgets.List
 
+// WatcherState is the scrape-able view of a single project's mirror status,
+// exposed over HTTP by the archive server's /debug/watcher endpoint.
+type WatcherState struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	LastFetch time.Time `json:"last_fetch"`
+	LastPush  time.Time `json:"last_push"`
+}
+
+var watcherStates = struct {
+	mu sync.Mutex
+	m  map[string]*WatcherState
+}{m: make(map[string]*WatcherState)}
+
+func watcherState(projectname string) *WatcherState {
+	watcherStates.mu.Lock()
+	defer watcherStates.mu.Unlock()
+	state, ok := watcherStates.m[projectname]
+	if !ok {
+		state = &WatcherState{Name: projectname}
+		watcherStates.m[projectname] = state
+	}
+	return state
+}
+
+func recordFetch(projectname string) {
+	state := watcherState(projectname)
+	watcherStates.mu.Lock()
+	state.LastFetch = time.Now()
+	watcherStates.mu.Unlock()
+}
+
+func recordPush(projectname string) {
+	state := watcherState(projectname)
+	watcherStates.mu.Lock()
+	state.LastPush = time.Now()
+	watcherStates.mu.Unlock()
+}
+
 func addOutputLine(text, projectname string) {
 	newEntry := fmt.Sprintf("[%s](fg:blue):\t %s", projectname, text)
 	textList.Rows = append(textList.Rows, newEntry)
@@ -253,6 +348,10 @@ func updateState(newstate, projectname string) {
 	} else {
 		repoList.Rows = append(repoList.Rows, []string{projectname, newstate})
 	}
+	state := watcherState(projectname)
+	watcherStates.mu.Lock()
+	state.Status = newstate
+	watcherStates.mu.Unlock()
 }
 
 func updateGridEnv() {
@@ -305,7 +404,11 @@ func main() {
 	drawFunction()
 	//	ui.Render(repoList, textList)
 
-	go startProcessing()
+	if *httpAddr != "" {
+		go startArchiveServer(*httpAddr)
+	}
+
+	go startDaemon()
 
 	ticker := time.NewTicker(time.Second).C
 
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// snapshotPath returns the path of the timestamped bare clone a project's
+// run at unixTime should live in: <data_path>/<localname>/<unix-ts>.git.
+func snapshotPath(localname string, unixTime int64) string {
+	return filepath.Join(cfg.DataPath, localname, fmt.Sprintf("%d.git", unixTime))
+}
+
+// listSnapshots returns every snapshot directory for a project, oldest first.
+func listSnapshots(localname string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(cfg.DataPath, localname))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamps []int64
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".git") {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".git"), 10, 64)
+		if err != nil {
+			continue
+		}
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	snapshots := make([]string, len(timestamps))
+	for i, ts := range timestamps {
+		snapshots[i] = snapshotPath(localname, ts)
+	}
+	return snapshots, nil
+}
+
+// snapshotUnchanged compares the newest snapshot's HEAD to the remote's HEAD
+// via a lightweight ls-remote, so processProject can skip an unnecessary
+// clone when nothing has changed upstream.
+func snapshotUnchanged(project Project) (bool, error) {
+	snapshots, err := listSnapshots(project.LocalName)
+	if err != nil || len(snapshots) == 0 {
+		return false, err
+	}
+
+	latest := snapshots[len(snapshots)-1]
+	repo, err := git.PlainOpen(latest)
+	if err != nil {
+		return false, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return false, err
+	}
+
+	remoteHead, err := lsRemoteHead(project.OriginURL)
+	if err != nil {
+		return false, err
+	}
+
+	return head.Hash().String() == remoteHead, nil
+}
+
+// lsRemoteHead shells out to `git ls-remote` to resolve HEAD without doing a
+// full clone or fetch.
+func lsRemoteHead(url string) (string, error) {
+	out, err := exec.Command("git", "ls-remote", url, "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty ls-remote output for %s", url)
+	}
+	return fields[0], nil
+}
+
+// pruneSnapshots removes all but the newest project.Keep snapshots, renaming
+// each to a temporary name before removal so a crash mid-prune never leaves a
+// snapshot directory that looks complete but isn't.
+func pruneSnapshots(project Project) error {
+	if project.Keep <= 0 {
+		return nil
+	}
+
+	snapshots, err := listSnapshots(project.LocalName)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) <= project.Keep {
+		return nil
+	}
+
+	stale := snapshots[:len(snapshots)-project.Keep]
+	for i, dir := range stale {
+		updateState(fmt.Sprintf("snapshot %d/%d", i+1, len(stale)), project.LocalName)
+		tmp := dir + ".stale"
+		if err := os.Rename(dir, tmp); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = time.Hour
+	defaultWorkerCount  = 4
+	maxBackoffShift     = 6
+)
+
+// refreshJob is one unit of work for the bounded worker pool: run
+// processProject for a project, then signal done (if anyone's waiting on it).
+type refreshJob struct {
+	project Project
+	done    chan struct{}
+}
+
+// triggerQueue is the bounded worker pool's work queue. It replaces the
+// unbounded `go processProject(...)` fan-out startProcessing used to do for
+// the initial pass; the initial pass, the poll-interval scheduler and
+// /trigger and /webhook/github all funnel through this single queue, so a
+// given project is never run by two goroutines at once.
+var triggerQueue = make(chan refreshJob, 256)
+
+func enqueue(project Project) {
+	triggerQueue <- refreshJob{project: project}
+}
+
+// enqueueAndWait enqueues every project and blocks until each has been run
+// exactly once by a worker.
+func enqueueAndWait(projects []Project) {
+	dones := make([]chan struct{}, len(projects))
+	for i, project := range projects {
+		done := make(chan struct{})
+		dones[i] = done
+		addActiveRepo(project.LocalName)
+		triggerQueue <- refreshJob{project: project, done: done}
+	}
+	for _, done := range dones {
+		<-done
+	}
+}
+
+type projectBackoff struct {
+	consecutiveErrors int
+	// running is held by a worker for the duration of processProject, so two
+	// queued jobs for the same project never run at once.
+	running sync.Mutex
+}
+
+var backoffState = struct {
+	mu sync.Mutex
+	m  map[string]*projectBackoff
+}{m: make(map[string]*projectBackoff)}
+
+func backoffFor(localname string) *projectBackoff {
+	backoffState.mu.Lock()
+	defer backoffState.mu.Unlock()
+	state, ok := backoffState.m[localname]
+	if !ok {
+		state = &projectBackoff{}
+		backoffState.m[localname] = state
+	}
+	return state
+}
+
+// startDaemon is the sole driver of processProject: it registers the /trigger
+// and /webhook/github HTTP endpoints, starts the bounded worker pool, runs the
+// initial pass to completion through it, and only then starts the per-project
+// poll-interval scheduling, so there is exactly one path that can run
+// processProject for a given project at any given time.
+func startDaemon() {
+	httpMux.HandleFunc("/trigger/", handleTrigger)
+	httpMux.HandleFunc("/webhook/github", handleGithubWebhook)
+
+	workerCount := cfg.Workers
+	if workerCount <= 0 {
+		workerCount = defaultWorkerCount
+	}
+	for i := 0; i < workerCount; i++ {
+		go worker()
+	}
+
+	startProcessing()
+
+	for _, project := range allProjects() {
+		go scheduleProject(project)
+	}
+}
+
+// startProcessing runs every known project through the worker pool once,
+// honoring cfg.Parallel: in parallel mode all projects are enqueued at once
+// (concurrency still capped by the worker pool), otherwise each project runs
+// to completion before the next is enqueued.
+func startProcessing() {
+	projects := allProjects()
+	if cfg.Parallel {
+		enqueueAndWait(projects)
+		return
+	}
+	for _, project := range projects {
+		enqueueAndWait([]Project{project})
+	}
+}
+
+func worker() {
+	for job := range triggerQueue {
+		state := backoffFor(job.project.LocalName)
+		state.running.Lock()
+		err := processProject(job.project)
+		state.running.Unlock()
+		backoffState.mu.Lock()
+		if err != nil {
+			state.consecutiveErrors++
+		} else {
+			state.consecutiveErrors = 0
+		}
+		backoffState.mu.Unlock()
+		if job.done != nil {
+			close(job.done)
+		}
+	}
+}
+
+// scheduleProject re-enqueues project on its poll interval forever, applying
+// exponential backoff with jitter after consecutive failures.
+func scheduleProject(project Project) {
+	for {
+		interval := pollInterval(project)
+		state := backoffFor(project.LocalName)
+		backoffState.mu.Lock()
+		errs := state.consecutiveErrors
+		backoffState.mu.Unlock()
+		if errs > 0 {
+			interval = backoffDuration(interval, errs)
+		}
+		time.Sleep(interval)
+		enqueue(project)
+	}
+}
+
+func pollInterval(project Project) time.Duration {
+	raw := project.PollInterval
+	if raw == "" {
+		raw = cfg.PollInterval
+	}
+	if raw == "" {
+		return defaultPollInterval
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid poll_interval %q for %s, using default: %v\n", raw, project.LocalName, err)
+		return defaultPollInterval
+	}
+	return d
+}
+
+func backoffDuration(base time.Duration, consecutiveErrors int) time.Duration {
+	shift := consecutiveErrors
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	backoff := base * time.Duration(uint64(1)<<uint(shift))
+	jitter := time.Duration(rand.Int63n(int64(backoff)/4 + 1))
+	return backoff + jitter
+}
+
+// handleTrigger handles POST /trigger/<localname>, enqueuing an immediate
+// refresh for the named project.
+func handleTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	localname := strings.TrimPrefix(r.URL.Path, "/trigger/")
+	project, ok := findProject(localname)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	enqueue(project)
+	fmt.Fprintf(w, "queued refresh for %s\n", localname)
+}
+
+// handleGithubWebhook handles POST /webhook/github, verifying the
+// X-Hub-Signature-256 header before enqueuing a refresh for the repo named
+// in the payload. With no webhook_secret configured the signature is not
+// checked and every request is accepted.
+func handleGithubWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !validGithubSignature(body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		Repository struct {
+			Name string `json:"name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "could not parse payload", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := findProject(payload.Repository.Name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	enqueue(project)
+	fmt.Fprintf(w, "queued refresh for %s\n", project.LocalName)
+}
+
+func validGithubSignature(body []byte, signatureHeader string) bool {
+	if cfg.WebhookSecret == "" {
+		return true
+	}
+	const prefix = "sha256="
+	if !strings.HasPrefix(signatureHeader, prefix) {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(strings.TrimPrefix(signatureHeader, prefix)))
+}
+
+func findProject(localname string) (Project, bool) {
+	for _, project := range allProjects() {
+		if project.LocalName == localname {
+			return project, true
+		}
+	}
+	return Project{}, false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Source describes a whole namespace (a user or an organisation) that should
+// be expanded into individual Projects on startup, instead of listing every
+// repository by hand in the config file.
+type Source struct {
+	Provider string `yaml:"provider"`
+	// URL is the base URL of the provider instance, e.g.
+	// "https://gitea.example.com". Required for gitea (which has no single
+	// public host); optional for gitlab (defaults to https://gitlab.com) and
+	// ignored for github.
+	URL        string   `yaml:"url"`
+	User       string   `yaml:"user"`
+	Token      string   `yaml:"token"`
+	Include    []string `yaml:"include"`
+	Exclude    []string `yaml:"exclude"`
+	Archived   *bool    `yaml:"archived"`
+	Forks      *bool    `yaml:"forks"`
+	Visibility string   `yaml:"visibility"`
+}
+
+// remoteRepo is the subset of fields we need from any provider's repo list
+// API, normalised so the matching/filtering code below doesn't care which
+// provider produced it.
+type remoteRepo struct {
+	Name       string
+	CloneURL   string
+	Archived   bool
+	Fork       bool
+	Visibility string
+}
+
+func resolveSources() ([]Project, error) {
+	var projects []Project
+	for _, source := range cfg.Sources {
+		repos, err := listRemoteRepos(source)
+		if err != nil {
+			log.Printf("Could not list repositories for source %s/%s: %v\n", source.Provider, source.User, err)
+			return nil, err
+		}
+		for _, repo := range repos {
+			if !matchesSource(source, repo) {
+				continue
+			}
+			projects = append(projects, Project{
+				LocalName: repo.Name,
+				OriginURL: repo.CloneURL,
+			})
+		}
+	}
+	return projects, nil
+}
+
+func matchesSource(source Source, repo remoteRepo) bool {
+	if source.Archived != nil && *source.Archived != repo.Archived {
+		return false
+	}
+	if source.Forks != nil && *source.Forks != repo.Fork {
+		return false
+	}
+	if source.Visibility != "" && source.Visibility != repo.Visibility {
+		return false
+	}
+	if len(source.Include) > 0 && !matchesAnyGlob(source.Include, repo.Name) {
+		return false
+	}
+	if matchesAnyGlob(source.Exclude, repo.Name) {
+		return false
+	}
+	return true
+}
+
+func matchesAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func listRemoteRepos(source Source) ([]remoteRepo, error) {
+	switch source.Provider {
+	case "github":
+		return listGithubRepos(source)
+	case "gitea":
+		return listGiteaRepos(source)
+	case "gitlab":
+		return listGitlabRepos(source)
+	default:
+		return nil, fmt.Errorf("unknown source provider %q", source.Provider)
+	}
+}
+
+func listGithubRepos(source Source) ([]remoteRepo, error) {
+	var repos []remoteRepo
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("https://api.github.com/users/%s/repos?per_page=100&page=%d", source.User, page)
+		var batch []struct {
+			Name     string `json:"name"`
+			CloneURL string `json:"clone_url"`
+			Archived bool   `json:"archived"`
+			Fork     bool   `json:"fork"`
+			Private  bool   `json:"private"`
+		}
+		if err := fetchPage("github", url, source.Token, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, r := range batch {
+			visibility := "public"
+			if r.Private {
+				visibility = "private"
+			}
+			repos = append(repos, remoteRepo{
+				Name:       r.Name,
+				CloneURL:   r.CloneURL,
+				Archived:   r.Archived,
+				Fork:       r.Fork,
+				Visibility: visibility,
+			})
+		}
+	}
+	return repos, nil
+}
+
+func listGiteaRepos(source Source) ([]remoteRepo, error) {
+	if source.URL == "" {
+		return nil, fmt.Errorf("gitea source for user %q is missing a url (e.g. https://gitea.example.com)", source.User)
+	}
+	var repos []remoteRepo
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v1/users/%s/repos?limit=50&page=%d", strings.TrimSuffix(source.URL, "/"), source.User, page)
+		var batch []struct {
+			Name     string `json:"name"`
+			CloneURL string `json:"clone_url"`
+			Archived bool   `json:"archived"`
+			Fork     bool   `json:"fork"`
+			Private  bool   `json:"private"`
+		}
+		if err := fetchPage("gitea", url, source.Token, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, r := range batch {
+			visibility := "public"
+			if r.Private {
+				visibility = "private"
+			}
+			repos = append(repos, remoteRepo{
+				Name:       r.Name,
+				CloneURL:   r.CloneURL,
+				Archived:   r.Archived,
+				Fork:       r.Fork,
+				Visibility: visibility,
+			})
+		}
+	}
+	return repos, nil
+}
+
+func listGitlabRepos(source Source) ([]remoteRepo, error) {
+	baseURL := source.URL
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	var repos []remoteRepo
+	namespace := "users"
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/%s/%s/projects?per_page=100&page=%d", strings.TrimSuffix(baseURL, "/"), namespace, source.User, page)
+		var batch []struct {
+			Name              string `json:"path"`
+			HTTPURLToRepo     string `json:"http_url_to_repo"`
+			Archived          bool   `json:"archived"`
+			ForkedFromProject *struct {
+			} `json:"forked_from_project"`
+			Visibility string `json:"visibility"`
+		}
+		if err := fetchPage("gitlab", url, source.Token, &batch); err != nil {
+			// source.User may name a group rather than a user.
+			if namespace == "users" && page == 1 {
+				namespace = "groups"
+				page = 0
+				continue
+			}
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, r := range batch {
+			repos = append(repos, remoteRepo{
+				Name:       r.Name,
+				CloneURL:   r.HTTPURLToRepo,
+				Archived:   r.Archived,
+				Fork:       r.ForkedFromProject != nil,
+				Visibility: r.Visibility,
+			})
+		}
+	}
+	return repos, nil
+}
+
+// fetchPage issues an authenticated GET and decodes the JSON body into out.
+// The auth header format is provider-specific: GitHub and Gitea both accept
+// "Authorization: token <x>", but GitLab's API only accepts PRIVATE-TOKEN
+// (or Authorization: Bearer).
+func fetchPage(provider, url, token string, out interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		if provider == "gitlab" {
+			req.Header.Set("PRIVATE-TOKEN", token)
+		} else {
+			req.Header.Set("Authorization", "token "+token)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d for %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}